@@ -0,0 +1,123 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// Content-addressing functions and locations lets samples reference them by
+// a deterministic hash computed in Go, instead of joining on their text
+// columns after a round-trip through the database (as sqlInsertLocations
+// used to, back when locations were looked up by (func, file_name, line)).
+
+// functionRow is a deduplicated row of profile_pprof_functions.
+type functionRow struct {
+	hash     int64
+	name     string
+	fileName string
+}
+
+// locationRow is a deduplicated row of profile_pprof_locations.
+type locationRow struct {
+	hash         int64
+	functionHash int64
+	line         int64
+}
+
+func functionHash(name, fileName string) int64 {
+	return int64(hashParts(name, fileName))
+}
+
+func locationHash(name, fileName string, line int64) int64 {
+	return int64(hashParts(name, fileName, strconv.FormatInt(line, 10)))
+}
+
+// hashParts combines parts into a single FNV-64a hash, NUL-separating them
+// so that e.g. ("ab", "c") and ("a", "bc") don't collide.
+func hashParts(parts ...string) uint64 {
+	h := fnv.New64a()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+const sqlCreateFunctionsTempTable = `CREATE TEMPORARY TABLE IF NOT EXISTS profile_pprof_functions_tmp (hash BIGINT, name TEXT, file_name TEXT) ON COMMIT DELETE ROWS;`
+
+var functionCopyColumns = []string{"hash", "name", "file_name"}
+
+const sqlInsertFunctions = `
+	INSERT INTO profile_pprof_functions (hash, name, file_name)
+	SELECT DISTINCT tmp.hash, tmp.name, tmp.file_name
+	FROM profile_pprof_functions_tmp AS tmp
+	ON CONFLICT (hash) DO NOTHING;`
+
+const sqlCreateLocationsTempTable = `CREATE TEMPORARY TABLE IF NOT EXISTS profile_pprof_locations_tmp (hash BIGINT, function_hash BIGINT, line INT) ON COMMIT DELETE ROWS;`
+
+var locationCopyColumns = []string{"hash", "function_hash", "line"}
+
+const sqlInsertLocations = `
+	INSERT INTO profile_pprof_locations (hash, function_hash, line)
+	SELECT DISTINCT tmp.hash, tmp.function_hash, tmp.line
+	FROM profile_pprof_locations_tmp AS tmp
+	ON CONFLICT (hash) DO NOTHING;`
+
+func functionCopyRows(functions map[int64]functionRow) [][]interface{} {
+	rows := make([][]interface{}, 0, len(functions))
+	for _, f := range functions {
+		rows = append(rows, []interface{}{f.hash, f.name, f.fileName})
+	}
+	return rows
+}
+
+func locationCopyRows(locations map[int64]locationRow) [][]interface{} {
+	rows := make([][]interface{}, 0, len(locations))
+	for _, l := range locations {
+		rows = append(rows, []interface{}{l.hash, l.functionHash, l.line})
+	}
+	return rows
+}
+
+// sampleRow is one sample's worth of data ready to COPY into its schema's
+// table: the content-addressed hashes of its call stack, plus its values.
+// sampleID is the sample's index within its profile's Sample slice; it is
+// the stable id profile_pprof_sample_labels stores alongside the same
+// build_id/token/created_at to join a sample back to its pprof labels.
+type sampleRow struct {
+	sampleID  int
+	locations []int64
+	values    [maxSampleValues]interface{}
+}
+
+// sampleCopySource streams sampleRows into a per-type samples table,
+// prefixing each with the constant build_id/token/created_at for the whole
+// profile.
+type sampleCopySource struct {
+	rows      []sampleRow
+	buildID   string
+	token     string
+	createdAt interface{}
+	numValues int
+	idx       int
+}
+
+func newSampleCopySource(rows []sampleRow, buildID, token string, createdAt interface{}, numValues int) *sampleCopySource {
+	return &sampleCopySource{rows: rows, buildID: buildID, token: token, createdAt: createdAt, numValues: numValues, idx: -1}
+}
+
+func (s *sampleCopySource) Next() bool {
+	s.idx++
+	return s.idx < len(s.rows)
+}
+
+func (s *sampleCopySource) Values() ([]interface{}, error) {
+	r := s.rows[s.idx]
+	values := []interface{}{s.buildID, s.token, s.createdAt, r.sampleID, r.locations}
+	for i := 0; i < s.numValues; i++ {
+		values = append(values, r.values[i])
+	}
+	return values, nil
+}
+
+func (s *sampleCopySource) Err() error { return nil }
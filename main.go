@@ -2,16 +2,18 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/google/pprof/profile"
-	"github.com/lib/pq"
-	"github.com/lib/pq/hstore"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pkg/errors"
 )
 
@@ -39,42 +41,95 @@ func (conf *DBConfig) RegisterFlags(fg *flag.FlagSet) {
 	fg.StringVar(&conf.Database, "pg.database", "pprof_data", "db name")
 }
 
+func openPostgres(conf DBConfig) (*pgxpool.Pool, error) {
+	poolConf, err := pgxpool.ParseConfig(conf.ConnString())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse db config")
+	}
+
+	// hstore's OID is assigned by CREATE EXTENSION, not baked into pgx's
+	// default type map, so it has to be looked up and registered on every
+	// new connection before services.labels can be encoded.
+	poolConf.AfterConnect = registerHstoreType
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConf)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open db")
+	}
+
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
+		return nil, errors.Wrap(err, "could not ping db")
+	}
+
+	return pool, nil
+}
+
+// registerHstoreType loads the hstore type from the connected database and
+// registers it on conn's type map, so pgtype.Hstore values can be
+// encoded/decoded. It is installed as a pgxpool AfterConnect hook.
+func registerHstoreType(ctx context.Context, conn *pgx.Conn) error {
+	hstoreType, err := conn.LoadType(ctx, "hstore")
+	if err != nil {
+		return errors.Wrap(err, `could not load "hstore" type (is the hstore extension installed?)`)
+	}
+	conn.TypeMap().RegisterType(hstoreType)
+	return nil
+}
+
+// pgxPoolCloser adapts *pgxpool.Pool.Close (which has no return value) to
+// the closer interface used by openStorage.
+type pgxPoolCloser struct {
+	pool *pgxpool.Pool
+}
+
+func (c pgxPoolCloser) Close() error {
+	c.pool.Close()
+	return nil
+}
+
 func main() {
+	log.SetOutput(os.Stdout)
+
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "serve" {
+		if err := runServe(args[1:]); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		return
+	}
+
 	var dbConf DBConfig
+	var storeConf StoreConfig
 
 	fg := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
 	dbConf.RegisterFlags(fg)
+	storeConf.RegisterFlags(fg)
 
-	if err := fg.Parse(os.Args[1:]); err != nil {
+	if err := fg.Parse(args); err != nil {
 		log.Fatal(err)
 	}
 
-	log.SetOutput(os.Stdout)
-
 	if len(fg.Args()) == 0 {
 		log.Fatal("no profiles passed")
 	}
 
-	if err := run(dbConf, fg.Args()...); err != nil {
+	if err := run(storeConf, dbConf, fg.Args()...); err != nil {
 		log.Fatalf("%+v\n", err)
 	}
 }
 
-func run(conf DBConfig, files ...string) error {
+func run(storeConf StoreConfig, dbConf DBConfig, files ...string) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	db, err := sql.Open("postgres", conf.ConnString())
+	storage, db, err := openStorage(storeConf, dbConf)
 	if err != nil {
-		return errors.Wrap(err, "could not open db")
+		return err
 	}
 	defer db.Close()
 
-	if err := db.Ping(); err != nil {
-		return errors.Wrap(err, "could not ping db")
-	}
-
 	meta := map[string]string{
 		"build_id": "456",
 		"token":    "fra.1",
@@ -83,8 +138,6 @@ func run(conf DBConfig, files ...string) error {
 		"host":     "backend-1",
 	}
 
-	storage := NewProfileStorage(db)
-
 	for _, f := range files {
 		if err := storage.CreateProfile(ctx, meta, f); err != nil {
 			return err
@@ -95,8 +148,10 @@ func run(conf DBConfig, files ...string) error {
 }
 
 type Profile struct {
-	prof *profile.Profile
+	prof   *profile.Profile
+	schema sampleTypeSchema
 
+	Type       ProfileType
 	BuildID    string
 	Token      string
 	Service    string
@@ -105,6 +160,19 @@ type Profile struct {
 	Labels     map[string]string
 }
 
+// sampleValues pads a sample's values out to maxSampleValues columns,
+// leaving the unused tail as NULL, so every schema's sample rows share one
+// fixed-size values array; only the schema's own value columns are written.
+func sampleValues(values []int64) [maxSampleValues]interface{} {
+	var out [maxSampleValues]interface{}
+	for i := range out {
+		if i < len(values) {
+			out[i] = values[i]
+		}
+	}
+	return out
+}
+
 func (p *Profile) Parse(filePath string) error {
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -112,7 +180,13 @@ func (p *Profile) Parse(filePath string) error {
 	}
 	defer f.Close()
 
-	prof, err := profile.Parse(f)
+	return p.ParseReader(f)
+}
+
+// ParseReader parses a profile from r, which may hold either a raw
+// profile.proto message or its gzip'd form.
+func (p *Profile) ParseReader(r io.Reader) error {
+	prof, err := profile.Parse(r)
 	if err != nil {
 		return err
 	}
@@ -123,48 +197,83 @@ func (p *Profile) Parse(filePath string) error {
 }
 
 type ProfileStorage struct {
-	db *sql.DB
+	pool *pgxpool.Pool
 }
 
-func NewProfileStorage(db *sql.DB) *ProfileStorage {
-	return &ProfileStorage{db}
+func NewProfileStorage(pool *pgxpool.Pool) *ProfileStorage {
+	return &ProfileStorage{pool}
 }
 
 const (
 	sqlInsertServices = `INSERT INTO services(build_id, token, name, labels) VALUES ($1, $2, $3, $4) ON CONFLICT (build_id, token) DO NOTHING;`
 
-	sqlInsertLocations = `
-		INSERT INTO profile_pprof_locations (func, file_name, line) 
-		SELECT tmp.func, tmp.file_name, tmp.line 
-		FROM profile_pprof_samples_tmp AS tmp ON CONFLICT DO NOTHING;`
-	sqlInsertSamples = `
-		INSERT INTO profile_pprof_samples_cpu (build_id, token, locations, created_at, value_cpu, value_nanos)
-		SELECT s.build_id, s.token, t.locations, s.created_at, t.value_cpu, t.value_nanos 
-		FROM (values ($1, $2, $3::timestamp)) as s (build_id, token, created_at),
-	  	(
-			SELECT sample_id, array_agg(l.location_id) as locations, value_cpu, value_nanos
-			FROM profile_pprof_samples_tmp tmp
-			INNER JOIN profile_pprof_locations l ON tmp.func = l.func AND tmp.file_name = l.file_name AND tmp.line = l.line
-			GROUP BY sample_id, value_cpu, value_nanos
-		) as t;`
+	sqlInsertSampleLabels = `
+		INSERT INTO profile_pprof_sample_labels (build_id, token, created_at, sample_id, key, value)
+		SELECT $1, $2, $3::timestamp, tmp.sample_id, tmp.key, tmp.value
+		FROM profile_pprof_sample_labels_tmp AS tmp;`
 )
 
-const sqlCreateTempTable = `CREATE TEMPORARY TABLE IF NOT EXISTS profile_pprof_samples_tmp (sample_id INTEGER, location_id INTEGER, func TEXT, file_name TEXT, line INT, value_cpu INTEGER, value_nanos INTEGER) ON COMMIT DELETE ROWS;`
-var sqlCopyTable = pq.CopyIn("profile_pprof_samples_tmp", "sample_id", "location_id", "func", "file_name", "line", "value_cpu", "value_nanos")
+const sqlCreateSampleLabelsTempTable = `CREATE TEMPORARY TABLE IF NOT EXISTS profile_pprof_sample_labels_tmp (sample_id INTEGER, key TEXT, value TEXT) ON COMMIT DELETE ROWS;`
+
+var sampleLabelCopyColumns = []string{"sample_id", "key", "value"}
+
+// sampleLabelCopyRow is one (sample, label key, label value) tuple.
+type sampleLabelCopyRow struct {
+	sampleID int
+	key      string
+	value    string
+}
+
+type sampleLabelCopySource struct {
+	rows []sampleLabelCopyRow
+	idx  int
+}
+
+func newSampleLabelCopySource(rows []sampleLabelCopyRow) *sampleLabelCopySource {
+	return &sampleLabelCopySource{rows: rows, idx: -1}
+}
+
+func (s *sampleLabelCopySource) Next() bool {
+	s.idx++
+	return s.idx < len(s.rows)
+}
+
+func (s *sampleLabelCopySource) Values() ([]interface{}, error) {
+	r := s.rows[s.idx]
+	return []interface{}{r.sampleID, r.key, r.value}, nil
+}
+
+func (s *sampleLabelCopySource) Err() error { return nil }
 
 func (s *ProfileStorage) CreateProfile(ctx context.Context, meta map[string]string, filePath string) error {
-	prof, err := s.createProfile(meta, filePath)
+	prof, err := parseProfile(meta, filePath)
 	if err != nil {
 		return errors.Wrapf(err, "could not parse profile %q", filePath)
 	}
 
-	tx, err := s.db.Begin()
+	return s.insertProfile(ctx, prof)
+}
+
+// CreateProfileReader behaves like CreateProfile, but reads the pprof data
+// from r instead of a file on disk. It is used by the HTTP ingestion
+// handler, where the profile arrives as a request body.
+func (s *ProfileStorage) CreateProfileReader(ctx context.Context, meta map[string]string, r io.Reader) error {
+	prof, err := parseProfileReader(meta, r)
+	if err != nil {
+		return errors.Wrap(err, "could not parse profile")
+	}
+
+	return s.insertProfile(ctx, prof)
+}
+
+func (s *ProfileStorage) insertProfile(ctx context.Context, prof *Profile) error {
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	_, err = tx.ExecContext(
+	_, err = tx.Exec(
 		ctx,
 		sqlInsertServices,
 		prof.BuildID,
@@ -176,78 +285,148 @@ func (s *ProfileStorage) CreateProfile(ctx context.Context, meta map[string]stri
 		return errors.Wrap(err, "could not INSERT service")
 	}
 
-	_, err = tx.ExecContext(ctx, sqlCreateTempTable)
-	if err != nil {
-		return errors.Wrapf(err, "could not create temp table %q", sqlCreateTempTable)
-	}
-
-	copyStmt, err := tx.PrepareContext(ctx, sqlCopyTable)
-	if err != nil {
-		return errors.Wrapf(err, "could not prepare COPY statement %q", sqlCopyTable)
-	}
+	functions := make(map[int64]functionRow)
+	locations := make(map[int64]locationRow)
+	sampleRows := make([]sampleRow, 0, len(prof.prof.Sample))
 
 	for sampleID, sample := range prof.prof.Sample {
-		for locID, loc := range sample.Location {
+		var locHashes []int64
+		for _, loc := range sample.Location {
 			for _, ln := range loc.Line {
-				_, err := copyStmt.ExecContext(
-					ctx,
-					sampleID,
-					locID,
-					ln.Function.Name,
-					ln.Function.Filename,
-					ln.Line,
-					sample.Value[0],
-					sample.Value[1],
-				)
-				if err != nil {
-					return errors.Wrap(err, "could not exec COPY statement")
-				}
+				fnHash := functionHash(ln.Function.Name, ln.Function.Filename)
+				functions[fnHash] = functionRow{hash: fnHash, name: ln.Function.Name, fileName: ln.Function.Filename}
+
+				locHash := locationHash(ln.Function.Name, ln.Function.Filename, ln.Line)
+				locations[locHash] = locationRow{hash: locHash, functionHash: fnHash, line: ln.Line}
+
+				locHashes = append(locHashes, locHash)
 			}
 		}
+		sampleRows = append(sampleRows, sampleRow{sampleID: sampleID, locations: locHashes, values: sampleValues(sample.Value)})
 	}
 
-	_, err = copyStmt.ExecContext(ctx)
-	if err != nil {
-		return errors.Wrap(err, "could not exec COPY statement")
+	if len(functions) > 0 {
+		if _, err := tx.Exec(ctx, sqlCreateFunctionsTempTable); err != nil {
+			return errors.Wrapf(err, "could not create temp table %q", sqlCreateFunctionsTempTable)
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"profile_pprof_functions_tmp"}, functionCopyColumns, pgx.CopyFromRows(functionCopyRows(functions))); err != nil {
+			return errors.Wrap(err, "could not copy function rows")
+		}
+		if _, err := tx.Exec(ctx, sqlInsertFunctions); err != nil {
+			return errors.Wrap(err, "could not insert functions")
+		}
 	}
 
-	_, err = tx.ExecContext(ctx, sqlInsertLocations)
-	if err != nil {
-		return errors.Wrap(err, "could not insert locations")
+	if len(locations) > 0 {
+		if _, err := tx.Exec(ctx, sqlCreateLocationsTempTable); err != nil {
+			return errors.Wrapf(err, "could not create temp table %q", sqlCreateLocationsTempTable)
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"profile_pprof_locations_tmp"}, locationCopyColumns, pgx.CopyFromRows(locationCopyRows(locations))); err != nil {
+			return errors.Wrap(err, "could not copy location rows")
+		}
+		if _, err := tx.Exec(ctx, sqlInsertLocations); err != nil {
+			return errors.Wrap(err, "could not insert locations")
+		}
 	}
 
-	_, err = tx.ExecContext(
-		ctx,
-		sqlInsertSamples,
-		prof.BuildID,
-		prof.Token,
-		prof.CreatedAt,
-	)
-	if err != nil {
-		return errors.Wrap(err, "could not insert samples")
+	sampleSource := newSampleCopySource(sampleRows, prof.BuildID, prof.Token, prof.CreatedAt, len(prof.schema.valueColumns))
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{prof.schema.table}, prof.schema.copyColumns(), sampleSource); err != nil {
+		return errors.Wrapf(err, "could not copy samples into %s", prof.schema.table)
 	}
 
-	if err := copyStmt.Close(); err != nil {
-		return errors.Wrap(err, "could not close COPY statement")
+	if _, err := tx.Exec(ctx, sqlCreateSampleLabelsTempTable); err != nil {
+		return errors.Wrapf(err, "could not create temp table %q", sqlCreateSampleLabelsTempTable)
 	}
 
-	if err := tx.Commit(); err != nil {
+	// sampleID here is the same prof.prof.Sample index stored as sampleRow.sampleID
+	// above, so a label row joins back to its sample via
+	// (build_id, token, created_at, sample_id).
+	var labelRows []sampleLabelCopyRow
+	for sampleID, sample := range prof.prof.Sample {
+		for key, values := range sample.Label {
+			for _, v := range values {
+				labelRows = append(labelRows, sampleLabelCopyRow{sampleID, key, v})
+			}
+		}
+		for key, values := range sample.NumLabel {
+			for _, v := range values {
+				labelRows = append(labelRows, sampleLabelCopyRow{sampleID, key, strconv.FormatInt(v, 10)})
+			}
+		}
+	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"profile_pprof_sample_labels_tmp"}, sampleLabelCopyColumns, newSampleLabelCopySource(labelRows)); err != nil {
+		return errors.Wrap(err, "could not copy sample label rows")
+	}
+
+	if _, err := tx.Exec(ctx, sqlInsertSampleLabels, prof.BuildID, prof.Token, prof.CreatedAt); err != nil {
+		return errors.Wrap(err, "could not insert sample labels")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		return errors.Wrap(err, "could not commit transaction")
 	}
 
 	return nil
 }
 
-func (s *ProfileStorage) createProfile(meta map[string]string, filePath string) (*Profile, error) {
+// parseProfile reads the profile at filePath and applies meta to it. It is
+// shared by every Storage implementation's CreateProfile.
+func parseProfile(meta map[string]string, filePath string) (*Profile, error) {
 	prof := &Profile{}
 	if err := prof.Parse(filePath); err != nil {
 		return nil, err
 	}
 
+	if err := finishProfile(prof, meta); err != nil {
+		return nil, err
+	}
+
+	return prof, nil
+}
+
+// parseProfileReader is parseProfile's counterpart for CreateProfileReader.
+func parseProfileReader(meta map[string]string, r io.Reader) (*Profile, error) {
+	prof := &Profile{}
+	if err := prof.ParseReader(r); err != nil {
+		return nil, err
+	}
+
+	if err := finishProfile(prof, meta); err != nil {
+		return nil, err
+	}
+
+	return prof, nil
+}
+
+// finishProfile applies meta onto prof and resolves its sample-type schema.
+func finishProfile(prof *Profile, meta map[string]string) error {
+	typeHint, err := applyMeta(prof, meta)
+	if err != nil {
+		return err
+	}
+
+	schema, err := resolveSchema(prof.prof, typeHint)
+	if err != nil {
+		return err
+	}
+	prof.Type = schema.typ
+	prof.schema = schema
+
+	return nil
+}
+
+// applyMeta copies the well-known metadata fields (build_id, token, service,
+// type, received_at) onto prof, treating anything else in meta as a
+// free-form label. It returns the "type" hint, if any, for schema
+// resolution.
+func applyMeta(prof *Profile, meta map[string]string) (string, error) {
 	if prof.prof.TimeNanos != 0 {
 		prof.CreatedAt = time.Unix(0, prof.prof.TimeNanos)
 	}
 
+	var typeHint string
+
 	for k, v := range meta {
 		switch k {
 		case "build_id":
@@ -256,10 +435,12 @@ func (s *ProfileStorage) createProfile(meta map[string]string, filePath string)
 			prof.Token = v
 		case "service":
 			prof.Service = v
+		case "type":
+			typeHint = v
 		case "received_at":
 			tm, err := time.Parse(time.RFC3339, v)
 			if err != nil {
-				return nil, err
+				return "", err
 			}
 			prof.ReceivedAt = tm
 		default:
@@ -270,15 +451,14 @@ func (s *ProfileStorage) createProfile(meta map[string]string, filePath string)
 		}
 	}
 
-	return prof, nil
+	return typeHint, nil
 }
 
-func hstoreFromLabels(labels map[string]string) hstore.Hstore {
-	hs := hstore.Hstore{
-		Map: make(map[string]sql.NullString, len(labels)),
-	}
+func hstoreFromLabels(labels map[string]string) pgtype.Hstore {
+	hs := make(pgtype.Hstore, len(labels))
 	for key, value := range labels {
-		hs.Map[key] = sql.NullString{String: value, Valid: true}
+		v := value
+		hs[key] = &v
 	}
 	return hs
 }
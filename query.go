@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/pkg/errors"
+)
+
+// ProfileQuery selects which ingested samples to reconstruct into a
+// *profile.Profile. Type picks the samples table to read (see
+// sampleTypeSchema); Service and Labels match against the services table
+// ingestion recorded each build_id/token under; SampleLabels match against
+// the per-sample pprof labels indexed into profile_pprof_sample_labels
+// (e.g. "goroutine_id", "endpoint", "span_id"); From/To bound created_at
+// and are inclusive, zero meaning unbounded.
+type ProfileQuery struct {
+	Type         ProfileType
+	Service      string
+	Labels       map[string]string
+	SampleLabels map[string]string
+	From         time.Time
+	To           time.Time
+}
+
+// queriedSample is one row read back from a samples table: the
+// content-addressed location hashes making up its call stack, and its
+// original values in schema.valueColumns order.
+type queriedSample struct {
+	locations []int64
+	values    []int64
+}
+
+// Query reverses the ingestion mapping for q.Type's samples table, merging
+// every matching sample into a single *profile.Profile suitable for
+// profile.Write.
+func (s *ProfileStorage) Query(ctx context.Context, q ProfileQuery) (*profile.Profile, error) {
+	schema, err := schemaByType(q.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlQuery, args := buildQuerySQL(schema, q)
+
+	rows, err := s.pool.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query samples")
+	}
+	defer rows.Close()
+
+	var samples []queriedSample
+	locationHashes := make(map[int64]struct{})
+
+	for rows.Next() {
+		var locs []int64
+		values := make([]int64, len(schema.valueColumns))
+
+		dest := make([]interface{}, 0, 1+len(values))
+		dest = append(dest, &locs)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrap(err, "could not scan sample row")
+		}
+
+		for _, h := range locs {
+			locationHashes[h] = struct{}{}
+		}
+		samples = append(samples, queriedSample{locations: locs, values: values})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read samples")
+	}
+
+	locationsByHash, err := s.loadLocations(ctx, locationHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	sampleTypes := valueTypesFromSchema(schema)
+	prof := &profile.Profile{
+		SampleType: sampleTypes,
+		// The period and its type aren't persisted anywhere by ingestion, so
+		// this is a best-effort placeholder good enough for go tool pprof to
+		// render the profile; it does not reflect the original capture.
+		PeriodType: sampleTypes[0],
+		Period:     1,
+	}
+
+	seenLocations := make(map[int64]bool, len(locationsByHash))
+	seenFunctions := make(map[uint64]bool)
+
+	for _, sample := range samples {
+		locations := make([]*profile.Location, 0, len(sample.locations))
+		for _, hash := range sample.locations {
+			loc, ok := locationsByHash[hash]
+			if !ok {
+				continue
+			}
+			if !seenLocations[hash] {
+				seenLocations[hash] = true
+				prof.Location = append(prof.Location, loc)
+				if fn := loc.Line[0].Function; fn != nil && !seenFunctions[fn.ID] {
+					seenFunctions[fn.ID] = true
+					prof.Function = append(prof.Function, fn)
+				}
+			}
+			locations = append(locations, loc)
+		}
+
+		values := make([]int64, len(sample.values))
+		copy(values, sample.values)
+
+		prof.Sample = append(prof.Sample, &profile.Sample{
+			Location: locations,
+			Value:    values,
+		})
+	}
+
+	return prof, nil
+}
+
+// buildQuerySQL builds the SELECT over schema's samples table for q,
+// joining services to filter on service name and labels. Placeholders are
+// numbered as they're appended, since which filters apply depends on which
+// ProfileQuery fields are set.
+func buildQuerySQL(schema sampleTypeSchema, q ProfileQuery) (string, []interface{}) {
+	var b strings.Builder
+	b.WriteString("SELECT s.locations, ")
+	b.WriteString(strings.Join(schema.valueColumns, ", "))
+	b.WriteString(" FROM ")
+	b.WriteString(schema.table)
+	b.WriteString(` AS s JOIN services AS sv ON sv.build_id = s.build_id AND sv.token = s.token WHERE true`)
+
+	var args []interface{}
+
+	if q.Service != "" {
+		args = append(args, q.Service)
+		fmt.Fprintf(&b, " AND sv.name = $%d", len(args))
+	}
+	if !q.From.IsZero() {
+		args = append(args, q.From)
+		fmt.Fprintf(&b, " AND s.created_at >= $%d", len(args))
+	}
+	if !q.To.IsZero() {
+		args = append(args, q.To)
+		fmt.Fprintf(&b, " AND s.created_at <= $%d", len(args))
+	}
+	for key, value := range q.Labels {
+		args = append(args, key, value)
+		fmt.Fprintf(&b, " AND sv.labels -> $%d = $%d", len(args)-1, len(args))
+	}
+	for key, value := range q.SampleLabels {
+		args = append(args, key, value)
+		fmt.Fprintf(&b, ` AND EXISTS (
+			SELECT 1 FROM profile_pprof_sample_labels AS sl
+			WHERE sl.build_id = s.build_id AND sl.token = s.token AND sl.created_at = s.created_at AND sl.sample_id = s.sample_id
+			AND sl.key = $%d AND sl.value = $%d
+		)`, len(args)-1, len(args))
+	}
+
+	return b.String(), args
+}
+
+const sqlSelectLocations = `SELECT hash, function_hash, line FROM profile_pprof_locations WHERE hash = ANY($1);`
+
+const sqlSelectFunctions = `SELECT hash, name, file_name FROM profile_pprof_functions WHERE hash = ANY($1);`
+
+// loadLocations resolves a set of location hashes back into *profile.Location
+// structs, fetching the functions they reference along the way.
+func (s *ProfileStorage) loadLocations(ctx context.Context, hashes map[int64]struct{}) (map[int64]*profile.Location, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]int64, 0, len(hashes))
+	for h := range hashes {
+		keys = append(keys, h)
+	}
+
+	rows, err := s.pool.Query(ctx, sqlSelectLocations, keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query locations")
+	}
+	defer rows.Close()
+
+	type locationRef struct {
+		hash, functionHash, line int64
+	}
+
+	var refs []locationRef
+	functionHashes := make(map[int64]struct{})
+
+	for rows.Next() {
+		var ref locationRef
+		if err := rows.Scan(&ref.hash, &ref.functionHash, &ref.line); err != nil {
+			return nil, errors.Wrap(err, "could not scan location row")
+		}
+		functionHashes[ref.functionHash] = struct{}{}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read locations")
+	}
+
+	functions, err := s.loadFunctions(ctx, functionHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := make(map[int64]*profile.Location, len(refs))
+	var nextID uint64 = 1
+	for _, ref := range refs {
+		locations[ref.hash] = &profile.Location{
+			ID:   nextID,
+			Line: []profile.Line{{Function: functions[ref.functionHash], Line: ref.line}},
+		}
+		nextID++
+	}
+
+	return locations, nil
+}
+
+// loadFunctions resolves a set of function hashes back into *profile.Function
+// structs.
+func (s *ProfileStorage) loadFunctions(ctx context.Context, hashes map[int64]struct{}) (map[int64]*profile.Function, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]int64, 0, len(hashes))
+	for h := range hashes {
+		keys = append(keys, h)
+	}
+
+	rows, err := s.pool.Query(ctx, sqlSelectFunctions, keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query functions")
+	}
+	defer rows.Close()
+
+	functions := make(map[int64]*profile.Function, len(keys))
+	var nextID uint64 = 1
+
+	for rows.Next() {
+		var hash int64
+		var name, fileName string
+		if err := rows.Scan(&hash, &name, &fileName); err != nil {
+			return nil, errors.Wrap(err, "could not scan function row")
+		}
+		functions[hash] = &profile.Function{ID: nextID, Name: name, Filename: fileName}
+		nextID++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read functions")
+	}
+
+	return functions, nil
+}
+
+// valueTypesFromSchema rebuilds a schema's "name/unit" sampleTypes back into
+// []*profile.ValueType.
+func valueTypesFromSchema(schema sampleTypeSchema) []*profile.ValueType {
+	types := make([]*profile.ValueType, len(schema.sampleTypes))
+	for i, st := range schema.sampleTypes {
+		parts := strings.SplitN(st, "/", 2)
+		types[i] = &profile.ValueType{Type: parts[0], Unit: parts[1]}
+	}
+	return types
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"github.com/pkg/errors"
+)
+
+// ProfileType identifies which kind of pprof sample profile (cpu, heap,
+// mutex, ...) a *profile.Profile carries. Each type is stored in its own
+// table, since the number and meaning of sample values differs per type.
+type ProfileType string
+
+const (
+	ProfileTypeCPU       ProfileType = "cpu"
+	ProfileTypeHeap      ProfileType = "heap"
+	ProfileTypeAllocs    ProfileType = "allocs"
+	ProfileTypeMutex     ProfileType = "mutex"
+	ProfileTypeBlock     ProfileType = "block"
+	ProfileTypeGoroutine ProfileType = "goroutine"
+)
+
+// maxSampleValues is the widest number of sample values any known schema
+// uses (heap: alloc_objects, alloc_space, inuse_objects, inuse_space).
+const maxSampleValues = 4
+
+// sampleTypeSchema describes how a profile of a given ProfileType is stored:
+// which table its samples live in and which columns its Sample.Value slots
+// map onto, in order.
+type sampleTypeSchema struct {
+	typ          ProfileType
+	sampleTypes  []string // "name/unit" pairs, in Sample.Value order
+	table        string
+	valueColumns []string
+}
+
+// copyColumns returns the column list for a CopyFrom straight into schema's
+// table: the fixed build_id/token/created_at/sample_id/locations columns
+// followed by schema's value columns. sample_id is the sample's index
+// within its profile and is what profile_pprof_sample_labels joins back on.
+func (s sampleTypeSchema) copyColumns() []string {
+	return append([]string{"build_id", "token", "created_at", "sample_id", "locations"}, s.valueColumns...)
+}
+
+// sampleTypeSignature returns the "name/unit,name/unit,..." signature of a
+// profile's declared sample types, used to look up its schema.
+func sampleTypeSignature(sampleTypes []*profile.ValueType) string {
+	parts := make([]string, len(sampleTypes))
+	for i, st := range sampleTypes {
+		parts[i] = st.Type + "/" + st.Unit
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s sampleTypeSchema) signature() string {
+	return strings.Join(s.sampleTypes, ",")
+}
+
+var knownSchemas = []sampleTypeSchema{
+	{
+		typ:          ProfileTypeCPU,
+		sampleTypes:  []string{"samples/count", "cpu/nanoseconds"},
+		table:        "profile_pprof_samples_cpu",
+		valueColumns: []string{"value_cpu", "value_nanos"},
+	},
+	{
+		typ:          ProfileTypeHeap,
+		sampleTypes:  []string{"alloc_objects/count", "alloc_space/bytes", "inuse_objects/count", "inuse_space/bytes"},
+		table:        "profile_pprof_samples_heap",
+		valueColumns: []string{"value_alloc_objects", "value_alloc_bytes", "value_inuse_objects", "value_inuse_bytes"},
+	},
+	{
+		// Go's runtime/pprof emits the exact same four sample types for
+		// "allocs" as it does for "heap" (they differ only in which one is
+		// the default sample type), so allocs shares heap's signature and
+		// is disambiguated the same way mutex/block are: by an explicit
+		// "type" meta field.
+		typ:          ProfileTypeAllocs,
+		sampleTypes:  []string{"alloc_objects/count", "alloc_space/bytes", "inuse_objects/count", "inuse_space/bytes"},
+		table:        "profile_pprof_samples_allocs",
+		valueColumns: []string{"value_alloc_objects", "value_alloc_bytes", "value_inuse_objects", "value_inuse_bytes"},
+	},
+	{
+		typ:          ProfileTypeMutex,
+		sampleTypes:  []string{"contentions/count", "delay/nanoseconds"},
+		table:        "profile_pprof_samples_mutex",
+		valueColumns: []string{"value_contentions", "value_delay_nanos"},
+	},
+	{
+		typ:          ProfileTypeBlock,
+		sampleTypes:  []string{"contentions/count", "delay/nanoseconds"},
+		table:        "profile_pprof_samples_block",
+		valueColumns: []string{"value_contentions", "value_delay_nanos"},
+	},
+	{
+		typ:          ProfileTypeGoroutine,
+		sampleTypes:  []string{"goroutine/count"},
+		table:        "profile_pprof_samples_goroutine",
+		valueColumns: []string{"value_count"},
+	},
+}
+
+// resolveSchema determines which sampleTypeSchema applies to prof.
+//
+// Most profile types have a sample-value layout unique enough to infer the
+// schema directly from SampleType. mutex/block ("contentions/count,
+// delay/nanoseconds") and heap/allocs (the four alloc_*/inuse_* columns),
+// however, are pairs that declare identical sample types with nothing in
+// the profile.proto itself to tell them apart, so callers must disambiguate
+// by passing an explicit "type" meta field (e.g. "type": "block").
+func resolveSchema(prof *profile.Profile, typeHint string) (sampleTypeSchema, error) {
+	sig := sampleTypeSignature(prof.SampleType)
+
+	var matches []sampleTypeSchema
+	for _, schema := range knownSchemas {
+		if schema.signature() == sig {
+			matches = append(matches, schema)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return sampleTypeSchema{}, errors.Errorf("unsupported pprof sample type layout %q", sig)
+	case 1:
+		if typeHint != "" && ProfileType(typeHint) != matches[0].typ {
+			return sampleTypeSchema{}, errors.Errorf("profile type %q does not match declared sample types %q", typeHint, sig)
+		}
+		return matches[0], nil
+	default:
+		for _, schema := range matches {
+			if schema.typ == ProfileType(typeHint) {
+				return schema, nil
+			}
+		}
+		return sampleTypeSchema{}, errors.Errorf("ambiguous sample type layout %q: pass an explicit \"type\" meta field to pick one of %v", sig, schemaTypes(matches))
+	}
+}
+
+// schemaByType looks up the known schema for typ directly, for callers (like
+// Query) that already know which table they want instead of inferring it
+// from a profile's SampleType.
+func schemaByType(typ ProfileType) (sampleTypeSchema, error) {
+	for _, schema := range knownSchemas {
+		if schema.typ == typ {
+			return schema, nil
+		}
+	}
+	return sampleTypeSchema{}, errors.Errorf("unknown profile type %q", typ)
+}
+
+func schemaTypes(schemas []sampleTypeSchema) []ProfileType {
+	types := make([]ProfileType, len(schemas))
+	for i, s := range schemas {
+		types[i] = s.typ
+	}
+	return types
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type ServeConfig struct {
+	DBConfig
+	StoreConfig
+
+	Addr string
+}
+
+func (conf *ServeConfig) RegisterFlags(fg *flag.FlagSet) {
+	conf.DBConfig.RegisterFlags(fg)
+	conf.StoreConfig.RegisterFlags(fg)
+	fg.StringVar(&conf.Addr, "http.addr", ":8080", "address to listen on for profile uploads")
+}
+
+func runServe(args []string) error {
+	var conf ServeConfig
+
+	fg := flag.NewFlagSet(os.Args[0]+" serve", flag.ExitOnError)
+	conf.RegisterFlags(fg)
+
+	if err := fg.Parse(args); err != nil {
+		return err
+	}
+
+	storage, db, err := openStorage(conf.StoreConfig, conf.DBConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	querier, _ := storage.(Querier)
+	srv := &ingestServer{storage: storage, querier: querier}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ingest", srv.handleIngest)
+	mux.HandleFunc("/profiles", srv.handleQuery)
+
+	log.Printf("listening on %s", conf.Addr)
+
+	return http.ListenAndServe(conf.Addr, mux)
+}
+
+// ingestServer handles uploads and downloads of pprof profiles over HTTP.
+// querier is nil when the configured Storage backend doesn't support
+// reconstructing profiles back out.
+type ingestServer struct {
+	storage Storage
+	querier Querier
+}
+
+// metaHeaders maps well-known metadata fields to the HTTP header they are
+// carried in. Any other "X-Pprof-Label-*" header is indexed as a free-form
+// label.
+var metaHeaders = map[string]string{
+	"build_id": "X-Pprof-Build-Id",
+	"token":    "X-Pprof-Token",
+	"service":  "X-Pprof-Service",
+	"dc":       "X-Pprof-Dc",
+	"host":     "X-Pprof-Host",
+}
+
+var labelHeaderPrefix = http.CanonicalHeaderKey("X-Pprof-Label-")
+
+func (s *ingestServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	meta := metaFromRequest(r)
+	if meta["build_id"] == "" || meta["token"] == "" {
+		http.Error(w, "build_id and token are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.storage.CreateProfileReader(r.Context(), meta, r.Body); err != nil {
+		log.Printf("could not ingest profile: %+v", err)
+		http.Error(w, "could not ingest profile", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// metaFromRequest collects profile metadata from the request's query
+// parameters and headers, query parameters taking precedence. Well-known
+// fields (build_id, token, service, dc, host) come from either source;
+// everything else in the query string, and any "X-Pprof-Label-*" header,
+// is treated as a free-form label.
+func metaFromRequest(r *http.Request) map[string]string {
+	meta := make(map[string]string)
+
+	for k, header := range metaHeaders {
+		if v := r.Header.Get(header); v != "" {
+			meta[k] = v
+		}
+	}
+
+	for key, values := range r.Header {
+		if len(values) == 0 {
+			continue
+		}
+		if name, ok := strippedLabelHeader(key); ok {
+			meta[name] = values[0]
+		}
+	}
+
+	for k, vs := range r.URL.Query() {
+		if len(vs) == 0 {
+			continue
+		}
+		meta[k] = vs[0]
+	}
+
+	return meta
+}
+
+func strippedLabelHeader(header string) (string, bool) {
+	if !strings.HasPrefix(header, labelHeaderPrefix) {
+		return "", false
+	}
+	name := strings.ToLower(header[len(labelHeaderPrefix):])
+	if name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+// queryLabelPrefix marks a query parameter as matching against a profile's
+// service labels, e.g. "label.dc=fra".
+const queryLabelPrefix = "label."
+
+// querySampleLabelPrefix marks a query parameter as matching against a
+// sample's pprof labels (Sample.Label/NumLabel), e.g.
+// "sample_label.endpoint=/v1/users".
+const querySampleLabelPrefix = "sample_label."
+
+// handleQuery serves GET /profiles?type=cpu&service=...&from=...&to=...&label.dc=fra&sample_label.endpoint=...,
+// downloading a .pb.gz reconstructed from every sample matching the query.
+func (s *ingestServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.querier == nil {
+		http.Error(w, "this storage backend does not support querying", http.StatusNotImplemented)
+		return
+	}
+
+	q, err := profileQueryFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prof, err := s.querier.Query(r.Context(), q)
+	if err != nil {
+		log.Printf("could not query profiles: %+v", err)
+		http.Error(w, "could not query profiles", http.StatusInternalServerError)
+		return
+	}
+
+	if len(prof.Sample) == 0 {
+		http.Error(w, "no matching profiles", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile.pb.gz"`)
+
+	if err := prof.Write(w); err != nil {
+		log.Printf("could not write profile: %+v", err)
+	}
+}
+
+// profileQueryFromRequest builds a ProfileQuery from r's query parameters.
+// type is required, since it picks which samples table to read; service,
+// from, to, any "label.*" parameter (service labels) and any
+// "sample_label.*" parameter (per-sample pprof labels) narrow the match
+// further.
+func profileQueryFromRequest(r *http.Request) (ProfileQuery, error) {
+	params := r.URL.Query()
+
+	typ := params.Get("type")
+	if typ == "" {
+		return ProfileQuery{}, errors.New(`"type" query parameter is required`)
+	}
+
+	q := ProfileQuery{
+		Type:         ProfileType(typ),
+		Service:      params.Get("service"),
+		Labels:       make(map[string]string),
+		SampleLabels: make(map[string]string),
+	}
+
+	if v := params.Get("from"); v != "" {
+		tm, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return ProfileQuery{}, errors.Wrap(err, `invalid "from"`)
+		}
+		q.From = tm
+	}
+	if v := params.Get("to"); v != "" {
+		tm, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return ProfileQuery{}, errors.Wrap(err, `invalid "to"`)
+		}
+		q.To = tm
+	}
+
+	for key, values := range params {
+		if len(values) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(key, querySampleLabelPrefix):
+			q.SampleLabels[strings.TrimPrefix(key, querySampleLabelPrefix)] = values[0]
+		case strings.HasPrefix(key, queryLabelPrefix):
+			q.Labels[strings.TrimPrefix(key, queryLabelPrefix)] = values[0]
+		}
+	}
+
+	return q, nil
+}
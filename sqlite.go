@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteBatchSize caps how many sample rows go into a single multi-row
+// INSERT, since SQLite limits the number of host parameters per statement.
+const sqliteBatchSize = 200
+
+// SQLiteStorage is a Storage backed by SQLite, for local development and
+// single-node deployments where running Postgres is overkill. Since SQLite
+// has neither COPY nor hstore, it batches rows into multi-row INSERTs
+// inside a single transaction and encodes labels as JSON in a TEXT column.
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+func NewSQLiteStorage(db *sql.DB) *SQLiteStorage {
+	return &SQLiteStorage{db}
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open db")
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "could not ping db")
+	}
+
+	return db, nil
+}
+
+const sqliteInsertService = `INSERT OR IGNORE INTO services(build_id, token, name, labels) VALUES (?, ?, ?, ?);`
+
+// sqliteSampleRow is a single row of profile_pprof_samples_<type>, with
+// locations and labels pre-encoded as JSON since SQLite has no array or
+// hstore type.
+type sqliteSampleRow struct {
+	values    [maxSampleValues]interface{}
+	locations string
+	labels    string
+}
+
+// sqliteLocation mirrors a profile.Line for JSON encoding into a sample's
+// locations column.
+type sqliteLocation struct {
+	Func string `json:"func"`
+	File string `json:"file"`
+	Line int64  `json:"line"`
+}
+
+func (s *SQLiteStorage) CreateProfile(ctx context.Context, meta map[string]string, filePath string) error {
+	prof, err := parseProfile(meta, filePath)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse profile %q", filePath)
+	}
+
+	return s.insertProfile(ctx, prof)
+}
+
+func (s *SQLiteStorage) CreateProfileReader(ctx context.Context, meta map[string]string, r io.Reader) error {
+	prof, err := parseProfileReader(meta, r)
+	if err != nil {
+		return errors.Wrap(err, "could not parse profile")
+	}
+
+	return s.insertProfile(ctx, prof)
+}
+
+func (s *SQLiteStorage) insertProfile(ctx context.Context, prof *Profile) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	labels, err := json.Marshal(prof.Labels)
+	if err != nil {
+		return errors.Wrap(err, "could not encode labels")
+	}
+
+	if _, err := tx.ExecContext(ctx, sqliteInsertService, prof.BuildID, prof.Token, prof.Service, string(labels)); err != nil {
+		return errors.Wrap(err, "could not INSERT service")
+	}
+
+	rows, err := sampleRows(prof)
+	if err != nil {
+		return errors.Wrap(err, "could not encode samples")
+	}
+
+	if err := s.insertSamples(ctx, tx, prof, rows); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "could not commit transaction")
+	}
+
+	return nil
+}
+
+// sampleRows converts a profile's samples into sqliteSampleRows, JSON
+// encoding each sample's call stack and per-sample labels.
+func sampleRows(prof *Profile) ([]sqliteSampleRow, error) {
+	rows := make([]sqliteSampleRow, 0, len(prof.prof.Sample))
+
+	for _, sample := range prof.prof.Sample {
+		locs := make([]sqliteLocation, 0, len(sample.Location))
+		for _, loc := range sample.Location {
+			for _, ln := range loc.Line {
+				locs = append(locs, sqliteLocation{
+					Func: ln.Function.Name,
+					File: ln.Function.Filename,
+					Line: ln.Line,
+				})
+			}
+		}
+		locsJSON, err := json.Marshal(locs)
+		if err != nil {
+			return nil, err
+		}
+
+		sampleLabels := make(map[string]string, len(sample.Label)+len(sample.NumLabel))
+		for key, values := range sample.Label {
+			if len(values) > 0 {
+				sampleLabels[key] = values[0]
+			}
+		}
+		for key, values := range sample.NumLabel {
+			if len(values) > 0 {
+				sampleLabels[key] = fmt.Sprintf("%d", values[0])
+			}
+		}
+		labelsJSON, err := json.Marshal(sampleLabels)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, sqliteSampleRow{
+			values:    sampleValues(sample.Value),
+			locations: string(locsJSON),
+			labels:    string(labelsJSON),
+		})
+	}
+
+	return rows, nil
+}
+
+// insertSamples batches rows into multi-row INSERTs of at most
+// sqliteBatchSize rows each, all within tx.
+func (s *SQLiteStorage) insertSamples(ctx context.Context, tx *sql.Tx, prof *Profile, rows []sqliteSampleRow) error {
+	valueCols := prof.schema.valueColumns
+	allCols := append([]string{"build_id", "token", "created_at", "locations", "labels"}, valueCols...)
+
+	for start := 0; start < len(rows); start += sqliteBatchSize {
+		end := start + sqliteBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batch := rows[start:end]
+
+		var placeholders []string
+		args := make([]interface{}, 0, len(batch)*len(allCols))
+		for _, row := range batch {
+			placeholders = append(placeholders, "("+strings.TrimSuffix(strings.Repeat("?,", len(allCols)), ",")+")")
+			args = append(args, prof.BuildID, prof.Token, prof.CreatedAt.Format(time.RFC3339Nano), row.locations, row.labels)
+			for _, v := range row.values[:len(valueCols)] {
+				args = append(args, v)
+			}
+		}
+
+		stmt := fmt.Sprintf(
+			"INSERT INTO %s (%s) VALUES %s;",
+			prof.schema.table,
+			strings.Join(allCols, ", "),
+			strings.Join(placeholders, ", "),
+		)
+
+		if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+			return errors.Wrapf(err, "could not insert samples into %s", prof.schema.table)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+
+	"github.com/google/pprof/profile"
+	"github.com/pkg/errors"
+)
+
+// Storage ingests pprof profiles, indexing their samples so they can later
+// be queried back out. ProfileStorage (Postgres) and SQLiteStorage are the
+// two implementations.
+type Storage interface {
+	CreateProfile(ctx context.Context, meta map[string]string, filePath string) error
+	CreateProfileReader(ctx context.Context, meta map[string]string, r io.Reader) error
+}
+
+// Querier is implemented by Storage backends that can reconstruct profiles
+// back out of what they ingested. Only ProfileStorage (Postgres) implements
+// it so far: SQLiteStorage does not, and stores each sample's call stack
+// inline as JSON rather than as content-addressed location hashes.
+type Querier interface {
+	Query(ctx context.Context, q ProfileQuery) (*profile.Profile, error)
+}
+
+// StoreConfig selects which Storage backend to use.
+type StoreConfig struct {
+	Driver     string
+	SQLitePath string
+}
+
+func (conf *StoreConfig) RegisterFlags(fg *flag.FlagSet) {
+	fg.StringVar(&conf.Driver, "store", "postgres", "storage backend: postgres or sqlite")
+	fg.StringVar(&conf.SQLitePath, "sqlite.path", "pprof_data.db", "path to the sqlite database file (when -store=sqlite)")
+}
+
+// openStorage opens the Storage backend selected by storeConf, returning it
+// alongside a closer for its underlying connection (the pgx pool or the
+// *sql.DB) so the caller can close it.
+func openStorage(storeConf StoreConfig, dbConf DBConfig) (Storage, closer, error) {
+	switch storeConf.Driver {
+	case "", "postgres":
+		pool, err := openPostgres(dbConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewProfileStorage(pool), pgxPoolCloser{pool}, nil
+	case "sqlite":
+		db, err := openSQLite(storeConf.SQLitePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewSQLiteStorage(db), db, nil
+	default:
+		return nil, nil, errors.Errorf("unknown -store %q, want %q or %q", storeConf.Driver, "postgres", "sqlite")
+	}
+}
+
+type closer interface {
+	Close() error
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// syntheticCPUProfile builds an in-memory CPU profile with n samples, each
+// carrying its own one-frame call stack, mimicking a large real-world
+// capture without needing a fixture file on disk.
+func syntheticCPUProfile(n int) *profile.Profile {
+	prof := &profile.Profile{
+		SampleType:    []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        10000000,
+		TimeNanos:     time.Now().UnixNano(),
+		DurationNanos: int64(10 * time.Second),
+	}
+
+	for i := 0; i < n; i++ {
+		fn := &profile.Function{
+			ID:       uint64(i + 1),
+			Name:     "func" + strconv.Itoa(i%500),
+			Filename: "file" + strconv.Itoa(i%50) + ".go",
+		}
+		loc := &profile.Location{
+			ID:   uint64(i + 1),
+			Line: []profile.Line{{Function: fn, Line: int64(i % 1000)}},
+		}
+		prof.Function = append(prof.Function, fn)
+		prof.Location = append(prof.Location, loc)
+		prof.Sample = append(prof.Sample, &profile.Sample{
+			Location: []*profile.Location{loc},
+			Value:    []int64{1, 10000},
+			Label:    map[string][]string{"endpoint": {"/v1/profile"}},
+		})
+	}
+
+	return prof
+}
+
+// BenchmarkCreateProfile measures CreateProfile's ingestion throughput on a
+// synthetic 50k-sample profile. It requires a reachable Postgres instance
+// with the project's schema loaded, configured via PPROF_TEST_PG_DSN; it is
+// skipped otherwise, since this repo has no embedded Postgres for CI.
+func BenchmarkCreateProfile(b *testing.B) {
+	dsn := os.Getenv("PPROF_TEST_PG_DSN")
+	if dsn == "" {
+		b.Skip("PPROF_TEST_PG_DSN not set")
+	}
+
+	ctx := context.Background()
+
+	poolConf, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		b.Fatalf("could not parse db config: %+v", err)
+	}
+	poolConf.AfterConnect = registerHstoreType
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConf)
+	if err != nil {
+		b.Fatalf("could not open db: %+v", err)
+	}
+	defer pool.Close()
+
+	storage := NewProfileStorage(pool)
+	prof := &Profile{prof: syntheticCPUProfile(50000)}
+
+	meta := map[string]string{
+		"build_id": "bench",
+		"token":    "bench.1",
+		"service":  "bench_service",
+	}
+	if err := finishProfile(prof, meta); err != nil {
+		b.Fatalf("could not finish profile: %+v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := storage.insertProfile(ctx, prof); err != nil {
+			b.Fatalf("CreateProfile: %+v", err)
+		}
+	}
+}